@@ -0,0 +1,71 @@
+/*
+ *
+ * Copyright 2023 puzzlewikiserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package migrations
+
+import (
+	"context"
+
+	"github.com/Masterminds/semver/v3"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// backfillCreatedAt demonstrates a data-shape change: older documents were
+// inserted before createdAt existed and rely on their ObjectId timestamp
+// instead, so this stamps an explicit createdAt from it.
+type backfillCreatedAt struct{}
+
+func (backfillCreatedAt) Version() *semver.Version {
+	return semver.MustParse("0.2.0")
+}
+
+func (backfillCreatedAt) Up(ctx context.Context, database *mongo.Database) error {
+	collection := database.Collection(pagesCollectionName)
+
+	cursor, err := collection.Find(ctx,
+		bson.D{{Key: "createdAt", Value: bson.D{{Key: "$exists", Value: false}}}},
+		options.Find().SetProjection(bson.D{{Key: "_id", Value: true}}),
+	)
+	if err != nil {
+		return err
+	}
+
+	var documents []bson.M
+	if err = cursor.All(ctx, &documents); err != nil {
+		return err
+	}
+
+	for _, document := range documents {
+		id, ok := document["_id"].(primitive.ObjectID)
+		if !ok {
+			continue
+		}
+
+		_, err = collection.UpdateOne(ctx,
+			bson.D{{Key: "_id", Value: id}},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "createdAt", Value: id.Timestamp()}}}},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+/*
+ *
+ * Copyright 2023 puzzlewikiserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package migrations
+
+import (
+	"context"
+
+	"github.com/Masterminds/semver/v3"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const pagesCollectionName = "pages"
+
+// createPagesIndexes creates the unique index that Store's duplicate-key
+// handling relies on, plus the descending-version index used to fetch the
+// latest version of a page.
+type createPagesIndexes struct{}
+
+func (createPagesIndexes) Version() *semver.Version {
+	return semver.MustParse("0.1.0")
+}
+
+func (createPagesIndexes) Up(ctx context.Context, database *mongo.Database) error {
+	_, err := database.Collection(pagesCollectionName).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{
+				{Key: "wikiId", Value: 1}, {Key: "ref", Value: 1}, {Key: "version", Value: 1},
+			},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{
+				{Key: "wikiId", Value: 1}, {Key: "ref", Value: 1}, {Key: "version", Value: -1},
+			},
+		},
+	})
+	return err
+}
@@ -0,0 +1,126 @@
+/*
+ *
+ * Copyright 2023 puzzlewikiserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+// mongoTestURIEnv names the environment variable pointing at a real MongoDB
+// deployment (a replica set, as in production) to run these tests
+// against, e.g. one started by a
+// docker-compose/testcontainers setup in CI.
+const mongoTestURIEnv = "MONGODB_TEST_URI"
+
+// connectForTest dials the MongoDB pointed at by MONGODB_TEST_URI and skips
+// the calling test when it isn't reachable, rather than faking the
+// connection: this test is meant to run against a real deployment.
+func connectForTest(t *testing.T) *mongo.Database {
+	t.Helper()
+
+	uri := os.Getenv(mongoTestURIEnv)
+	if uri == "" {
+		t.Skipf("%s not set; skipping integration test that needs a real MongoDB replica set", mongoTestURIEnv)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatalf("connect to %s: %v", mongoTestURIEnv, err)
+	}
+	if err = client.Ping(ctx, nil); err != nil {
+		t.Skipf("%s unreachable: %v", mongoTestURIEnv, err)
+	}
+
+	database := client.Database(fmt.Sprintf("puzzlewikiserver_migrations_test_%d", time.Now().UnixNano()))
+	t.Cleanup(func() {
+		dropCtx, dropCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer dropCancel()
+		_ = database.Drop(dropCtx)
+		_ = client.Disconnect(dropCtx)
+	})
+	return database
+}
+
+// TestRunIsIdempotentFromAnIntermediateVersion runs Run against a real
+// MongoDB deployment as if an older replica had only ever seen the first
+// known migration, then as if a newer replica booted with the full set: the
+// newer replica should apply only what the older one left pending, and
+// running it again afterwards should apply nothing further.
+func TestRunIsIdempotentFromAnIntermediateVersion(t *testing.T) {
+	database := connectForTest(t)
+	ctx := context.Background()
+	logger := otelzap.New(zap.NewNop())
+
+	all := All()
+	if len(all) < 2 {
+		t.Fatalf("need at least 2 migrations to exercise an intermediate version, got %d", len(all))
+	}
+
+	if err := Run(ctx, database, logger, all[:1]); err != nil {
+		t.Fatalf("Run (intermediate version): %v", err)
+	}
+
+	applied, err := appliedVersions(ctx, database)
+	if err != nil {
+		t.Fatalf("appliedVersions: %v", err)
+	}
+	if len(applied) != 1 || !applied[all[0].Version().String()] {
+		t.Fatalf("expected only %s applied after the intermediate run, got %v", all[0].Version(), applied)
+	}
+
+	if err = Run(ctx, database, logger, all); err != nil {
+		t.Fatalf("Run (full set): %v", err)
+	}
+
+	applied, err = appliedVersions(ctx, database)
+	if err != nil {
+		t.Fatalf("appliedVersions: %v", err)
+	}
+	for _, migration := range all {
+		if !applied[migration.Version().String()] {
+			t.Fatalf("expected %s to be applied, got %v", migration.Version(), applied)
+		}
+	}
+
+	// running again from a fully up-to-date state must not re-apply or
+	// re-record anything.
+	if err = Run(ctx, database, logger, all); err != nil {
+		t.Fatalf("Run (rerun from up-to-date): %v", err)
+	}
+
+	count, err := database.Collection(schemaMigrationsCollectionName).CountDocuments(ctx, map[string]any{})
+	if err != nil {
+		t.Fatalf("count schema_migrations: %v", err)
+	}
+	if count != int64(len(all)) {
+		t.Fatalf("expected exactly %d schema_migrations documents, got %d (migrations were re-recorded)", len(all), count)
+	}
+}
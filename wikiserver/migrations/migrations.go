@@ -0,0 +1,219 @@
+/*
+ *
+ * Copyright 2023 puzzlewikiserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package migrations manages the schema (indexes and data shape) of the
+// pages collection, applying pending changes once at startup.
+package migrations
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+const schemaMigrationsCollectionName = "schema_migrations"
+const leaseCollectionName = "schema_migrations_lease"
+
+const versionKey = "version"
+const appliedAtKey = "appliedAt"
+
+const leaseId = "lease"
+const leaseHeldUntilKey = "heldUntil"
+const leaseTokenKey = "token"
+
+const leaseDuration = time.Minute
+const leaseHeartbeatInterval = leaseDuration / 3
+const leaseRetryDelay = 500 * time.Millisecond
+const leaseRetryCount = 20
+
+const migrationCallMsg = "Failed while running migrations"
+
+// Migration is a single, idempotent change to the pages collection's schema
+// (indexes) or data shape, identified by a semantic version.
+type Migration interface {
+	Version() *semver.Version
+	Up(ctx context.Context, database *mongo.Database) error
+}
+
+// All returns every migration known to this package, in no particular
+// order; Run sorts them by version before applying.
+func All() []Migration {
+	return []Migration{createPagesIndexes{}, backfillCreatedAt{}, createTextIndex{}}
+}
+
+// Run applies every migration whose version has not yet been recorded in
+// the schema_migrations collection, in ascending version order, under a
+// lease so that replicas racing at boot do not double-apply a migration.
+func Run(ctx context.Context, database *mongo.Database, logger *otelzap.Logger, migrations []Migration) error {
+	log := logger.Ctx(ctx)
+
+	l, err := acquireLease(ctx, database)
+	if err != nil {
+		log.Error(migrationCallMsg, zap.Error(err))
+		return err
+	}
+	defer l.release(context.Background())
+
+	applied, err := appliedVersions(ctx, database)
+	if err != nil {
+		log.Error(migrationCallMsg, zap.Error(err))
+		return err
+	}
+
+	schemaMigrations := database.Collection(schemaMigrationsCollectionName)
+	for _, migration := range pending(migrations, applied) {
+		version := migration.Version()
+
+		if err = migration.Up(ctx, database); err != nil {
+			log.Error(migrationCallMsg, zap.Error(err))
+			return err
+		}
+
+		_, err = schemaMigrations.InsertOne(ctx, bson.M{versionKey: version.String(), appliedAtKey: time.Now()})
+		if err != nil {
+			log.Error(migrationCallMsg, zap.Error(err))
+			return err
+		}
+	}
+	return nil
+}
+
+// pending returns migrations whose version is not in applied, sorted in
+// ascending version order, so re-running Run from any intermediate version
+// only applies what's left and running it again afterwards applies nothing.
+func pending(migrations []Migration, applied map[string]bool) []Migration {
+	sorted := make([]Migration, len(migrations))
+	copy(sorted, migrations)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version().LessThan(sorted[j].Version()) })
+
+	result := make([]Migration, 0, len(sorted))
+	for _, migration := range sorted {
+		if !applied[migration.Version().String()] {
+			result = append(result, migration)
+		}
+	}
+	return result
+}
+
+func appliedVersions(ctx context.Context, database *mongo.Database) (map[string]bool, error) {
+	cursor, err := database.Collection(schemaMigrationsCollectionName).Find(
+		ctx, bson.D{}, options.Find().SetProjection(bson.D{{Key: versionKey, Value: true}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []bson.M
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+
+	applied := make(map[string]bool, len(results))
+	for _, result := range results {
+		if version, _ := result[versionKey].(string); version != "" {
+			applied[version] = true
+		}
+	}
+	return applied, nil
+}
+
+// lease holds the migration lease for as long as a Run call needs it,
+// renewing its expiry in the background so a run longer than leaseDuration
+// (backfillCreatedAt, for instance, can take a while on a large collection)
+// doesn't let another booting replica see it as stale and take over.
+type lease struct {
+	collection *mongo.Collection
+	token      string
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// acquireLease takes the migration lease by racing an upsert against its
+// expiry, so a replica whose lease is stale (crashed mid-run) can take
+// over, then starts the renewal loop.
+func acquireLease(ctx context.Context, database *mongo.Database) (*lease, error) {
+	collection := database.Collection(leaseCollectionName)
+	token := primitive.NewObjectID().Hex()
+
+	for attempt := 0; attempt < leaseRetryCount; attempt++ {
+		now := time.Now()
+		_, err := collection.UpdateOne(ctx,
+			bson.D{{Key: "_id", Value: leaseId}, {Key: leaseHeldUntilKey, Value: bson.D{{Key: "$lt", Value: now}}}},
+			bson.D{{Key: "$set", Value: bson.D{
+				{Key: leaseHeldUntilKey, Value: now.Add(leaseDuration)}, {Key: leaseTokenKey, Value: token},
+			}}},
+			options.Update().SetUpsert(true),
+		)
+		if err == nil {
+			l := &lease{collection: collection, token: token, stop: make(chan struct{}), done: make(chan struct{})}
+			go l.renew()
+			return l, nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return nil, err
+		}
+
+		select {
+		case <-time.After(leaseRetryDelay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return nil, mongo.ErrNoDocuments
+}
+
+// renew pushes the lease's expiry forward on a tick, as long as it still
+// holds our token, until stopped.
+func (l *lease) renew() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(leaseHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), leaseRetryDelay)
+			_, _ = l.collection.UpdateOne(ctx,
+				bson.D{{Key: "_id", Value: leaseId}, {Key: leaseTokenKey, Value: l.token}},
+				bson.D{{Key: "$set", Value: bson.D{{Key: leaseHeldUntilKey, Value: time.Now().Add(leaseDuration)}}}},
+			)
+			cancel()
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// release stops the renewal loop and deletes the lease document, but only
+// the copy still carrying our token: a fencing check so a replica whose
+// lease already expired and got reassigned can never delete the new
+// holder's lease out from under it.
+func (l *lease) release(ctx context.Context) {
+	close(l.stop)
+	<-l.done
+	_, _ = l.collection.DeleteOne(ctx, bson.D{{Key: "_id", Value: leaseId}, {Key: leaseTokenKey, Value: l.token}})
+}
@@ -0,0 +1,91 @@
+/*
+ *
+ * Copyright 2023 puzzlewikiserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package migrations
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Masterminds/semver/v3"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type fakeMigration struct {
+	version string
+	calls   *int
+}
+
+func (m fakeMigration) Version() *semver.Version { return semver.MustParse(m.version) }
+
+func (m fakeMigration) Up(ctx context.Context, database *mongo.Database) error {
+	*m.calls++
+	return nil
+}
+
+func TestPendingSortsByVersionAndSkipsApplied(t *testing.T) {
+	var calls int
+	all := []Migration{
+		fakeMigration{version: "0.2.0", calls: &calls},
+		fakeMigration{version: "0.1.0", calls: &calls},
+		fakeMigration{version: "0.3.0", calls: &calls},
+	}
+
+	result := pending(all, map[string]bool{"0.1.0": true})
+
+	if len(result) != 2 {
+		t.Fatalf("expected 2 pending migrations, got %d", len(result))
+	}
+	if result[0].Version().String() != "0.2.0" || result[1].Version().String() != "0.3.0" {
+		t.Fatalf("expected pending migrations in ascending order from the first unapplied version, got %s, %s",
+			result[0].Version(), result[1].Version())
+	}
+}
+
+// TestPendingIsIdempotentFromAnIntermediateVersion verifies that running
+// from an intermediate applied state only re-applies what's left, and that
+// running again from the resulting fully-applied state applies nothing -
+// the idempotency Run relies on, at the pure decision-making level (a full
+// run against a real replica set is better covered by an integration test).
+func TestPendingIsIdempotentFromAnIntermediateVersion(t *testing.T) {
+	var calls int
+	all := []Migration{
+		fakeMigration{version: "0.1.0", calls: &calls},
+		fakeMigration{version: "0.2.0", calls: &calls},
+	}
+
+	applied := map[string]bool{"0.1.0": true}
+	first := pending(all, applied)
+	if len(first) != 1 || first[0].Version().String() != "0.2.0" {
+		t.Fatalf("expected only 0.2.0 pending from an intermediate version, got %v", first)
+	}
+	for _, migration := range first {
+		if err := migration.Up(context.Background(), nil); err != nil {
+			t.Fatalf("Up: %v", err)
+		}
+		applied[migration.Version().String()] = true
+	}
+	if calls != 1 {
+		t.Fatalf("expected Up to run once, got %d", calls)
+	}
+
+	second := pending(all, applied)
+	if len(second) != 0 {
+		t.Fatalf("expected no pending migrations on rerun from an up-to-date version, got %v", second)
+	}
+}
@@ -0,0 +1,41 @@
+/*
+ *
+ * Copyright 2023 puzzlewikiserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package migrations
+
+import (
+	"context"
+
+	"github.com/Masterminds/semver/v3"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// createTextIndex creates the text index that Search relies on.
+type createTextIndex struct{}
+
+func (createTextIndex) Version() *semver.Version {
+	return semver.MustParse("0.3.0")
+}
+
+func (createTextIndex) Up(ctx context.Context, database *mongo.Database) error {
+	_, err := database.Collection(pagesCollectionName).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "text", Value: "text"}},
+	})
+	return err
+}
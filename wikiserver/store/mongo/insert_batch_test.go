@@ -0,0 +1,113 @@
+/*
+ *
+ * Copyright 2023 puzzlewikiserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package mongo
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/dvaumoron/puzzlewikiserver/wikiserver/store"
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+	"go.uber.org/zap"
+)
+
+// TestInsertSequentialContinuesPastDuplicateKey covers the useTransactions
+// false path: each entry is inserted on its own, so one duplicate version
+// fails that entry without aborting the rest of the batch.
+func TestInsertSequentialContinuesPastDuplicateKey(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("sequential", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateWriteErrorsResponse(mtest.WriteError{
+			Index: 0, Code: 11000, Message: "duplicate key",
+		}))
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+
+		s := pageStore{client: mt.Client, collection: mt.Coll, logger: otelzap.New(zap.NewNop())}
+
+		pages := []store.Page{
+			{WikiId: 1, WikiRef: "a", Version: 1},
+			{WikiId: 1, WikiRef: "b", Version: 1},
+		}
+		results := s.insertSequential(context.Background(), pages)
+
+		if len(results) != 2 {
+			t.Fatalf("expected 2 results, got %d", len(results))
+		}
+		if results[0].Success || !errors.Is(results[0].Err, store.ErrDuplicateVersion) {
+			t.Fatalf("expected first entry to fail as a duplicate, got %+v", results[0])
+		}
+		if !results[1].Success || results[1].Err != nil {
+			t.Fatalf("expected second entry to still be attempted and succeed, got %+v", results[1])
+		}
+	})
+}
+
+// TestInsertBatchTransactionalRollsBackAllOnFailure covers the
+// useTransactions true path: unlike the sequential path, a single duplicate
+// version aborts the whole transaction, so every entry in the batch comes
+// back as failed, not just the one that collided.
+//
+// This drives session.WithTransaction through a mocked replica-set
+// deployment rather than a real one, so it is a best-effort simulation of
+// the wire protocol (insert, then abortTransaction) rather than a full
+// integration test against a live MongoDB replica set.
+func TestInsertBatchTransactionalRollsBackAllOnFailure(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock).Topologies(mtest.ReplicaSet))
+
+	mt.Run("transactional", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+		mt.AddMockResponses(mtest.CreateWriteErrorsResponse(mtest.WriteError{
+			Index: 0, Code: 11000, Message: "duplicate key",
+		}))
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+
+		s := pageStore{
+			client: mt.Client, collection: mt.Coll, useTransactions: true,
+			logger: otelzap.New(zap.NewNop()),
+		}
+
+		pages := []store.Page{
+			{WikiId: 1, WikiRef: "a", Version: 1},
+			{WikiId: 1, WikiRef: "b", Version: 1},
+		}
+		results, err := s.InsertBatch(context.Background(), pages)
+		if err != nil {
+			t.Fatalf("InsertBatch: %v", err)
+		}
+
+		for i, result := range results {
+			if result.Success || result.Err == nil {
+				t.Fatalf("expected entry %d to be rolled back along with the rest of the batch, got %+v", i, result)
+			}
+		}
+		// the second entry is the one whose duplicate version actually
+		// triggered the abort (the first insert got a success response);
+		// its reason should say so specifically, rather than reuse the same
+		// generic reason as the other entry.
+		if !errors.Is(results[1].Err, store.ErrDuplicateVersion) {
+			t.Fatalf("expected entry 1's reason to name its own duplicate version, got %+v", results[1])
+		}
+		if errors.Is(results[0].Err, store.ErrDuplicateVersion) {
+			t.Fatalf("expected entry 0's reason to point at entry 1, not claim its own duplicate version, got %+v", results[0])
+		}
+	})
+}
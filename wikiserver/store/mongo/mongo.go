@@ -0,0 +1,374 @@
+/*
+ *
+ * Copyright 2023 puzzlewikiserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package mongo implements wikiserver/store.Store on top of MongoDB.
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	mongoclient "github.com/dvaumoron/puzzlemongoclient"
+	"github.com/dvaumoron/puzzlewikiserver/wikiserver/migrations"
+	"github.com/dvaumoron/puzzlewikiserver/wikiserver/store"
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+const collectionName = "pages"
+
+const wikiIdKey = "wikiId"
+const wikiRefKey = "ref"
+const versionKey = "version"
+const textKey = "text"
+const userIdKey = "userId"
+const createdAtKey = "createdAt"
+
+const mongoCallMsg = "Failed during MongoDB call"
+
+var descVersion = bson.D{{Key: versionKey, Value: -1}}
+var contentFields = bson.D{
+	// exclude unused fields
+	{Key: wikiIdKey, Value: false}, {Key: wikiRefKey, Value: false}, {Key: userIdKey, Value: false},
+}
+var optsContentMaxVersion = options.FindOne().SetSort(descVersion).SetProjection(contentFields)
+var optsContentFields = options.FindOne().SetProjection(contentFields)
+var optsVersion = options.Find().SetProjection(
+	bson.D{{Key: versionKey, Value: true}, {Key: userIdKey, Value: true}},
+)
+
+// pageStore implements store.Store on top of MongoDB, keeping a single
+// pooled *mongo.Client (and its collection handle) for the lifetime of the
+// process instead of connecting/disconnecting on every call.
+type pageStore struct {
+	client          *mongo.Client
+	collection      *mongo.Collection
+	useTransactions bool
+	logger          *otelzap.Logger
+}
+
+// New connects to MongoDB using uri (pool size, TLS and read/write-concern
+// are configured through the connection string, as with the official
+// MongoDB tools), pings it to fail fast on misconfiguration, runs the
+// pending schema migrations, and returns a store.Store backed by that
+// single retained client. Callers should call Close on shutdown.
+//
+// useTransactions enables multi-document transactions for InsertBatch; it
+// requires the target deployment to be a replica set or sharded cluster,
+// so it must be turned off against a standalone instance.
+func New(ctx context.Context, uri string, databaseName string, useTransactions bool, logger *otelzap.Logger) (store.Store, error) {
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		logger.Error(mongoCallMsg, zap.Error(err))
+		return nil, err
+	}
+
+	if err = client.Ping(ctx, nil); err != nil {
+		logger.Error(mongoCallMsg, zap.Error(err))
+		_ = client.Disconnect(ctx)
+		return nil, err
+	}
+
+	database := client.Database(databaseName)
+	if err = migrations.Run(ctx, database, logger, migrations.All()); err != nil {
+		_ = client.Disconnect(ctx)
+		return nil, err
+	}
+
+	collection := database.Collection(collectionName)
+	return pageStore{
+		client: client, collection: collection, useTransactions: useTransactions, logger: logger,
+	}, nil
+}
+
+// Ping reports whether the retained client can still reach the server, for
+// use in a readiness probe.
+func (s pageStore) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx, nil)
+}
+
+// Close releases the retained client's connection pool.
+func (s pageStore) Close(ctx context.Context) error {
+	return s.client.Disconnect(ctx)
+}
+
+func (s pageStore) Load(ctx context.Context, wikiId uint64, wikiRef string, version uint64) (*store.Page, error) {
+	logger := s.logger.Ctx(ctx)
+	collection := s.collection
+
+	filters := bson.D{{Key: wikiIdKey, Value: wikiId}, {Key: wikiRefKey, Value: wikiRef}}
+
+	opts := optsContentMaxVersion
+	if version != 0 {
+		filters = append(filters, bson.E{Key: versionKey, Value: version})
+		opts = optsContentFields
+	}
+
+	var result bson.M
+	if err := collection.FindOne(ctx, filters, opts).Decode(&result); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+
+		logger.Error(mongoCallMsg, zap.Error(err))
+		return nil, err
+	}
+	return convertToPage(wikiId, wikiRef, result), nil
+}
+
+func (s pageStore) Insert(ctx context.Context, page store.Page) error {
+	logger := s.logger.Ctx(ctx)
+
+	doc := bson.M{
+		wikiIdKey: page.WikiId, wikiRefKey: page.WikiRef, versionKey: page.Version,
+		userIdKey: page.UserId, textKey: page.Text, createdAtKey: time.Now(),
+	}
+
+	if _, err := s.collection.InsertOne(ctx, doc); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return store.ErrDuplicateVersion
+		}
+
+		logger.Error(mongoCallMsg, zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+func (s pageStore) InsertBatch(ctx context.Context, pages []store.Page) ([]store.BatchResult, error) {
+	if !s.useTransactions {
+		return s.insertSequential(ctx, pages), nil
+	}
+
+	logger := s.logger.Ctx(ctx)
+
+	session, err := s.client.StartSession()
+	if err != nil {
+		logger.Error(mongoCallMsg, zap.Error(err))
+		return nil, err
+	}
+	defer session.EndSession(ctx)
+
+	results := make([]store.BatchResult, len(pages))
+	duplicateIndex := -1
+	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (any, error) {
+		for i, page := range pages {
+			doc := bson.M{
+				wikiIdKey: page.WikiId, wikiRefKey: page.WikiRef, versionKey: page.Version,
+				userIdKey: page.UserId, textKey: page.Text, createdAtKey: time.Now(),
+			}
+
+			if _, err := s.collection.InsertOne(sessCtx, doc); err != nil {
+				if mongo.IsDuplicateKeyError(err) {
+					duplicateIndex = i
+					return nil, store.ErrDuplicateVersion
+				}
+				return nil, err
+			}
+			results[i] = store.BatchResult{Success: true}
+		}
+		return nil, nil
+	})
+	if err != nil {
+		if errors.Is(err, store.ErrDuplicateVersion) {
+			// the whole transaction was rolled back, so none of the entries
+			// committed, but only duplicateIndex actually collided; name it
+			// in every entry's reason so a caller knows which one to fix.
+			for i := range results {
+				if i == duplicateIndex {
+					results[i] = store.BatchResult{
+						Success: false, Err: fmt.Errorf("entry %d: %w; transaction aborted", i, store.ErrDuplicateVersion),
+					}
+				} else {
+					results[i] = store.BatchResult{
+						Success: false, Err: fmt.Errorf("aborted: entry %d failed", duplicateIndex),
+					}
+				}
+			}
+			return results, nil
+		}
+
+		logger.Error(mongoCallMsg, zap.Error(err))
+		return nil, err
+	}
+	return results, nil
+}
+
+func (s pageStore) insertSequential(ctx context.Context, pages []store.Page) []store.BatchResult {
+	results := make([]store.BatchResult, len(pages))
+	for i, page := range pages {
+		err := s.Insert(ctx, page)
+		results[i] = store.BatchResult{Success: err == nil, Err: err}
+	}
+	return results
+}
+
+func (s pageStore) ListVersions(ctx context.Context, wikiId uint64, wikiRef string) ([]store.Version, error) {
+	logger := s.logger.Ctx(ctx)
+
+	cursor, err := s.collection.Find(ctx, bson.D{
+		{Key: wikiIdKey, Value: wikiId}, {Key: wikiRefKey, Value: wikiRef},
+	}, optsVersion)
+	if err != nil {
+		logger.Error(mongoCallMsg, zap.Error(err))
+		return nil, err
+	}
+
+	var results []bson.M
+	if err = cursor.All(ctx, &results); err != nil {
+		logger.Error(mongoCallMsg, zap.Error(err))
+		return nil, err
+	}
+	return mongoclient.ConvertSlice(results, convertToVersion), nil
+}
+
+func (s pageStore) DeleteVersion(ctx context.Context, wikiId uint64, wikiRef string, version uint64) error {
+	logger := s.logger.Ctx(ctx)
+
+	_, err := s.collection.DeleteMany(ctx, bson.D{
+		{Key: wikiIdKey, Value: wikiId}, {Key: wikiRefKey, Value: wikiRef},
+		{Key: versionKey, Value: version},
+	})
+	if err != nil {
+		logger.Error(mongoCallMsg, zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+const snippetLength = 200
+
+// Search runs the text query against the raw collection first: a $match
+// containing $text must be the pipeline's first stage, so the latest
+// matching version of each page is selected only after that match, not
+// before it (a page whose latest version doesn't itself match the query
+// still surfaces, with its latest version that does match).
+func (s pageStore) Search(ctx context.Context, wikiId uint64, query string, limit, offset int64) ([]store.SearchResult, error) {
+	logger := s.logger.Ctx(ctx)
+
+	match := bson.D{{Key: "$text", Value: bson.D{{Key: "$search", Value: query}}}}
+	if wikiId != 0 {
+		match = append(bson.D{{Key: wikiIdKey, Value: wikiId}}, match...)
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$sort", Value: descVersion}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{{Key: wikiIdKey, Value: "$" + wikiIdKey}, {Key: wikiRefKey, Value: "$" + wikiRefKey}}},
+			{Key: versionKey, Value: bson.D{{Key: "$first", Value: "$" + versionKey}}},
+			{Key: textKey, Value: bson.D{{Key: "$first", Value: "$" + textKey}}},
+			{Key: createdAtKey, Value: bson.D{{Key: "$first", Value: "$" + createdAtKey}}},
+		}}},
+	}
+	if offset > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$skip", Value: offset}})
+	}
+	// limit of 0 (the proto3 zero value) means "no limit", shared with the
+	// postgres backend; $limit rejects a non-positive argument, so it must
+	// be omitted rather than passed through.
+	if limit > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: limit}})
+	}
+
+	cursor, err := s.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		logger.Error(mongoCallMsg, zap.Error(err))
+		return nil, err
+	}
+
+	var results []bson.M
+	if err = cursor.All(ctx, &results); err != nil {
+		logger.Error(mongoCallMsg, zap.Error(err))
+		return nil, err
+	}
+	return mongoclient.ConvertSlice(results, func(page bson.M) store.SearchResult {
+		return convertToSearchResult(page, query)
+	}), nil
+}
+
+func convertToSearchResult(page bson.M, query string) store.SearchResult {
+	id, _ := page["_id"].(bson.M)
+	wikiRef, _ := id[wikiRefKey].(string)
+	text, _ := page[textKey].(string)
+	return store.SearchResult{
+		WikiId: mongoclient.ExtractUint64(id[wikiIdKey]), WikiRef: wikiRef,
+		Version: mongoclient.ExtractUint64(page[versionKey]), Snippet: snippet(text, query),
+		// the $group stage above overwrites _id with {wikiId, ref}, so it no
+		// longer holds the real document's ObjectID; read the createdAt
+		// carried through by $first instead of extracting it from _id.
+		CreatedAt: extractDate(page[createdAtKey]),
+	}
+}
+
+// extractDate reads a createdAt value decoded into a bson.M, which comes
+// back as primitive.DateTime rather than time.Time.
+func extractDate(value any) time.Time {
+	dt, _ := value.(primitive.DateTime)
+	return dt.Time()
+}
+
+// snippetRadius is how much context to keep on each side of the match
+// within a snippet.
+const snippetRadius = 100
+
+// snippet returns a window of text around the first case-insensitive
+// occurrence of query, so the match actually appears in the snippet instead
+// of being cut off by a blind prefix.
+func snippet(text, query string) string {
+	if len(text) <= snippetLength {
+		return text
+	}
+
+	start := 0
+	if index := strings.Index(strings.ToLower(text), strings.ToLower(query)); index >= 0 {
+		start = index - snippetRadius
+		if start < 0 {
+			start = 0
+		}
+	}
+
+	end := start + snippetLength
+	if end > len(text) {
+		end = len(text)
+		start = end - snippetLength
+	}
+	return text[start:end]
+}
+
+func convertToPage(wikiId uint64, wikiRef string, page bson.M) *store.Page {
+	text, _ := page[textKey].(string)
+	return &store.Page{
+		WikiId: wikiId, WikiRef: wikiRef, Version: mongoclient.ExtractUint64(page[versionKey]),
+		Text: text, CreatedAt: mongoclient.ExtractCreateDate(page),
+	}
+}
+
+func convertToVersion(page bson.M) store.Version {
+	return store.Version{
+		Number: mongoclient.ExtractUint64(page[versionKey]),
+		UserId: mongoclient.ExtractUint64(page[userIdKey]),
+	}
+}
@@ -0,0 +1,67 @@
+/*
+ *
+ * Copyright 2023 puzzlewikiserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package mongo
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"testing"
+)
+
+// TestNewIsTheOnlyCallerOfConnect is a structural guard for the "single
+// pooled client" guarantee described on New and pageStore: every other
+// method hangs off the client/collection retained at construction time, so
+// nothing in this package should call mongo.Connect a second time and open a
+// fresh connection per request. Exercising this against a live deployment
+// would be a stronger test, but this still catches a method accidentally
+// reaching for mongo.Connect instead of s.client/s.collection.
+func TestNewIsTheOnlyCallerOfConnect(t *testing.T) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "mongo.go", nil, 0)
+	if err != nil {
+		t.Fatalf("parse mongo.go: %v", err)
+	}
+
+	var callers []string
+	for _, decl := range file.Decls {
+		funcDecl, ok := decl.(*ast.FuncDecl)
+		if !ok || funcDecl.Body == nil {
+			continue
+		}
+
+		ast.Inspect(funcDecl.Body, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			sel, ok := call.Fun.(*ast.SelectorExpr)
+			if ok && sel.Sel.Name == "Connect" {
+				if ident, ok := sel.X.(*ast.Ident); ok && ident.Name == "mongo" {
+					callers = append(callers, funcDecl.Name.Name)
+				}
+			}
+			return true
+		})
+	}
+
+	if len(callers) != 1 || callers[0] != "New" {
+		t.Fatalf("expected mongo.Connect to be called only from New, found calls from %v", callers)
+	}
+}
@@ -0,0 +1,260 @@
+/*
+ *
+ * Copyright 2023 puzzlewikiserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package postgres implements wikiserver/store.Store on top of PostgreSQL.
+//
+// The pages table is expected to be created ahead of time:
+//
+//	CREATE TABLE pages (
+//		wiki_id    BIGINT NOT NULL,
+//		ref        TEXT NOT NULL,
+//		version    BIGINT NOT NULL,
+//		user_id    BIGINT NOT NULL,
+//		text       TEXT NOT NULL,
+//		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+//		UNIQUE(wiki_id, ref, version)
+//	);
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/dvaumoron/puzzlewikiserver/wikiserver/store"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.uber.org/zap"
+)
+
+const pgCallMsg = "Failed during PostgreSQL call"
+
+const uniqueViolationCode = "23505"
+
+// pageStore implements store.Store on top of a PostgreSQL pages table.
+type pageStore struct {
+	pool   *pgxpool.Pool
+	logger *otelzap.Logger
+}
+
+func New(pool *pgxpool.Pool, logger *otelzap.Logger) store.Store {
+	return pageStore{pool: pool, logger: logger}
+}
+
+func (s pageStore) Load(ctx context.Context, wikiId uint64, wikiRef string, version uint64) (*store.Page, error) {
+	logger := s.logger.Ctx(ctx)
+
+	var row pgx.Row
+	if version == 0 {
+		row = s.pool.QueryRow(ctx, `
+			SELECT version, user_id, text, created_at FROM pages
+			WHERE wiki_id = $1 AND ref = $2 ORDER BY version DESC LIMIT 1`, wikiId, wikiRef)
+	} else {
+		row = s.pool.QueryRow(ctx, `
+			SELECT version, user_id, text, created_at FROM pages
+			WHERE wiki_id = $1 AND ref = $2 AND version = $3`, wikiId, wikiRef, version)
+	}
+
+	page := store.Page{WikiId: wikiId, WikiRef: wikiRef}
+	if err := row.Scan(&page.Version, &page.UserId, &page.Text, &page.CreatedAt); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+
+		logger.Error(pgCallMsg, zap.Error(err))
+		return nil, err
+	}
+	return &page, nil
+}
+
+func (s pageStore) Insert(ctx context.Context, page store.Page) error {
+	logger := s.logger.Ctx(ctx)
+
+	_, err := s.pool.Exec(ctx, `
+		INSERT INTO pages (wiki_id, ref, version, user_id, text) VALUES ($1, $2, $3, $4, $5)`,
+		page.WikiId, page.WikiRef, page.Version, page.UserId, page.Text,
+	)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == uniqueViolationCode {
+			return store.ErrDuplicateVersion
+		}
+
+		logger.Error(pgCallMsg, zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+func (s pageStore) InsertBatch(ctx context.Context, pages []store.Page) ([]store.BatchResult, error) {
+	logger := s.logger.Ctx(ctx)
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		logger.Error(pgCallMsg, zap.Error(err))
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	results := make([]store.BatchResult, len(pages))
+	for i, page := range pages {
+		_, err = tx.Exec(ctx, `
+			INSERT INTO pages (wiki_id, ref, version, user_id, text) VALUES ($1, $2, $3, $4, $5)`,
+			page.WikiId, page.WikiRef, page.Version, page.UserId, page.Text,
+		)
+		if err != nil {
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) && pgErr.Code == uniqueViolationCode {
+				// the transaction is aborted, so none of the entries
+				// committed, but only entry i actually collided; name it in
+				// every entry's reason so a caller knows which one to fix.
+				for j := range results {
+					if j == i {
+						results[j] = store.BatchResult{
+							Success: false, Err: fmt.Errorf("entry %d: %w; transaction aborted", i, store.ErrDuplicateVersion),
+						}
+					} else {
+						results[j] = store.BatchResult{
+							Success: false, Err: fmt.Errorf("aborted: entry %d failed", i),
+						}
+					}
+				}
+				return results, nil
+			}
+
+			logger.Error(pgCallMsg, zap.Error(err))
+			return nil, err
+		}
+		results[i] = store.BatchResult{Success: true}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		logger.Error(pgCallMsg, zap.Error(err))
+		return nil, err
+	}
+	return results, nil
+}
+
+const snippetLength = 200
+
+// snippetRadius is how much context to keep on each side of the match
+// within a snippet.
+const snippetRadius = 100
+
+// snippet returns a window of text around the first case-insensitive
+// occurrence of query, so the match actually appears in the snippet instead
+// of being cut off by a blind prefix.
+func snippet(text, query string) string {
+	if len(text) <= snippetLength {
+		return text
+	}
+
+	start := 0
+	if index := strings.Index(strings.ToLower(text), strings.ToLower(query)); index >= 0 {
+		start = index - snippetRadius
+		if start < 0 {
+			start = 0
+		}
+	}
+
+	end := start + snippetLength
+	if end > len(text) {
+		end = len(text)
+		start = end - snippetLength
+	}
+	return text[start:end]
+}
+
+// Search queries the pages table. limit of 0 (the proto3 zero value) means
+// "no limit", the same convention shared with the mongo backend: it is
+// passed through NULLIF so it becomes a SQL NULL, under which LIMIT NULL
+// returns every row instead of the zero rows a literal "LIMIT 0" would.
+func (s pageStore) Search(ctx context.Context, wikiId uint64, query string, limit, offset int64) ([]store.SearchResult, error) {
+	logger := s.logger.Ctx(ctx)
+
+	rows, err := s.pool.Query(ctx, `
+		SELECT DISTINCT ON (wiki_id, ref) wiki_id, ref, version, text, created_at FROM pages
+		WHERE ($1 = 0 OR wiki_id = $1) AND to_tsvector('simple', text) @@ plainto_tsquery('simple', $2)
+		ORDER BY wiki_id, ref, version DESC
+		LIMIT NULLIF($3, 0) OFFSET $4`, wikiId, query, limit, offset,
+	)
+	if err != nil {
+		logger.Error(pgCallMsg, zap.Error(err))
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []store.SearchResult
+	for rows.Next() {
+		var result store.SearchResult
+		var text string
+		if err = rows.Scan(&result.WikiId, &result.WikiRef, &result.Version, &text, &result.CreatedAt); err != nil {
+			logger.Error(pgCallMsg, zap.Error(err))
+			return nil, err
+		}
+		result.Snippet = snippet(text, query)
+		results = append(results, result)
+	}
+	if err = rows.Err(); err != nil {
+		logger.Error(pgCallMsg, zap.Error(err))
+		return nil, err
+	}
+	return results, nil
+}
+
+func (s pageStore) ListVersions(ctx context.Context, wikiId uint64, wikiRef string) ([]store.Version, error) {
+	logger := s.logger.Ctx(ctx)
+
+	rows, err := s.pool.Query(ctx, `
+		SELECT version, user_id FROM pages WHERE wiki_id = $1 AND ref = $2`, wikiId, wikiRef)
+	if err != nil {
+		logger.Error(pgCallMsg, zap.Error(err))
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []store.Version
+	for rows.Next() {
+		var version store.Version
+		if err = rows.Scan(&version.Number, &version.UserId); err != nil {
+			logger.Error(pgCallMsg, zap.Error(err))
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	if err = rows.Err(); err != nil {
+		logger.Error(pgCallMsg, zap.Error(err))
+		return nil, err
+	}
+	return versions, nil
+}
+
+func (s pageStore) DeleteVersion(ctx context.Context, wikiId uint64, wikiRef string, version uint64) error {
+	logger := s.logger.Ctx(ctx)
+
+	_, err := s.pool.Exec(ctx, `
+		DELETE FROM pages WHERE wiki_id = $1 AND ref = $2 AND version = $3`, wikiId, wikiRef, version)
+	if err != nil {
+		logger.Error(pgCallMsg, zap.Error(err))
+		return err
+	}
+	return nil
+}
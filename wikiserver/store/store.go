@@ -0,0 +1,101 @@
+/*
+ *
+ * Copyright 2023 puzzlewikiserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package store defines the persistence contract used by wikiserver, so the
+// gRPC layer can be backed by different databases (see store/mongo, store/postgres).
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrDuplicateVersion is returned by Insert when the (wikiId, wikiRef, version)
+// triple already exists, mirroring a unique constraint violation.
+var ErrDuplicateVersion = errors.New("version already exists")
+
+// Page is the backend-agnostic representation of a stored wiki page version.
+type Page struct {
+	WikiId    uint64
+	WikiRef   string
+	Version   uint64
+	UserId    uint64
+	Text      string
+	CreatedAt time.Time
+}
+
+// Version is the backend-agnostic representation of a page version summary.
+type Version struct {
+	Number uint64
+	UserId uint64
+}
+
+// Store abstracts the persistence of wiki pages behind the operations
+// required by wikiserver, so the backend (MongoDB, PostgreSQL, ...) can be
+// picked by configuration rather than hardcoded.
+type Store interface {
+	// Load retrieves a page version, or the latest one when version is 0.
+	// It returns (nil, nil) when no matching page exists.
+	Load(ctx context.Context, wikiId uint64, wikiRef string, version uint64) (*Page, error)
+	// Insert stores a new page version. It returns ErrDuplicateVersion when
+	// the version already exists instead of an error, mirroring the previous
+	// duplicate-key handling.
+	Insert(ctx context.Context, page Page) error
+	// ListVersions returns every known version for a wiki page.
+	ListVersions(ctx context.Context, wikiId uint64, wikiRef string) ([]Version, error)
+	// DeleteVersion removes a single page version.
+	DeleteVersion(ctx context.Context, wikiId uint64, wikiRef string, version uint64) error
+	// InsertBatch inserts every page. Backends that support it do so inside
+	// a single transaction (all-or-nothing); others insert sequentially.
+	// The returned slice always has one BatchResult per input page, in order.
+	InsertBatch(ctx context.Context, pages []Page) ([]BatchResult, error)
+	// Search returns the latest version of every (wikiId, wikiRef) pair
+	// whose text matches query; results are not ranked by relevance. wikiId of 0 searches
+	// across every wiki. offset paginates the results; limit caps how many
+	// are returned, with 0 (the proto3 zero value) meaning no limit.
+	Search(ctx context.Context, wikiId uint64, query string, limit, offset int64) ([]SearchResult, error)
+}
+
+// SearchResult is a single match returned by Store.Search.
+type SearchResult struct {
+	WikiId    uint64
+	WikiRef   string
+	Version   uint64
+	Snippet   string
+	CreatedAt time.Time
+}
+
+// BatchResult reports the outcome of inserting a single page as part of an
+// InsertBatch call.
+type BatchResult struct {
+	Success bool
+	Err     error
+}
+
+// Pinger is implemented by Store backends that can report whether the
+// underlying database is reachable, for use in readiness probes.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Closer is implemented by Store backends holding resources (connections,
+// pools) that must be released on shutdown.
+type Closer interface {
+	Close(ctx context.Context) error
+}
@@ -0,0 +1,91 @@
+/*
+ *
+ * Copyright 2023 puzzlewikiserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package wikiserver
+
+import pb "github.com/dvaumoron/puzzlewikiservice"
+
+// RestoreRequest, DiffRequest and DiffResult back RPCs (Restore, Diff) that
+// extend the Wiki service beyond what puzzlewikiservice currently declares.
+// They live here, as plain Go types, rather than in the pb package, until a
+// matching wiki.proto change ships upstream; server exposes these RPCs as
+// ordinary methods in the meantime, alongside the four it implements from
+// pb.WikiServer.
+
+// RestoreRequest asks for a past version of a page to be reinstated as the
+// newest version, recorded as authored by UserId.
+type RestoreRequest struct {
+	WikiId  uint64
+	WikiRef string
+	Version uint64
+	UserId  uint64
+}
+
+// DiffRequest asks for a unified diff between two versions of a page.
+type DiffRequest struct {
+	WikiId      uint64
+	WikiRef     string
+	FromVersion uint64
+	ToVersion   uint64
+}
+
+// DiffResult carries the unified diff produced from a DiffRequest.
+type DiffResult struct {
+	Patch string
+}
+
+// BatchContentRequest asks for every Entries to be stored as a single unit
+// (see server.StoreBatch); each entry reuses pb.ContentRequest's shape since
+// it is identical to what a single Store call already takes.
+type BatchContentRequest struct {
+	Entries []*pb.ContentRequest
+}
+
+// BatchResult reports the outcome of storing a single entry from a
+// BatchContentRequest, with Reason set when Success is false.
+type BatchResult struct {
+	Success bool
+	Reason  string
+}
+
+// BatchResponse carries one BatchResult per BatchContentRequest.Entries, in order.
+type BatchResponse struct {
+	Results []*BatchResult
+}
+
+// SearchRequest asks for the latest version of every page matching Query,
+// optionally scoped to a single wiki, paginated by Limit/Offset.
+type SearchRequest struct {
+	WikiId uint64
+	Query  string
+	Limit  int64
+	Offset int64
+}
+
+// SearchResult is a single match returned from a SearchRequest.
+type SearchResult struct {
+	WikiRef   string
+	Version   uint64
+	Snippet   string
+	CreatedAt int64
+}
+
+// SearchResults carries every SearchResult matching a SearchRequest.
+type SearchResults struct {
+	List []*SearchResult
+}
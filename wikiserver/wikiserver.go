@@ -22,177 +22,232 @@ import (
 	"context"
 	"errors"
 
-	mongoclient "github.com/dvaumoron/puzzlemongoclient"
+	"github.com/dvaumoron/puzzlewikiserver/wikiserver/store"
 	pb "github.com/dvaumoron/puzzlewikiservice"
+	"github.com/sergi/go-diff/diffmatchpatch"
 	"github.com/uptrace/opentelemetry-go-extra/otelzap"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.uber.org/zap"
 )
 
 const WikiKey = "puzzleWiki"
 
-const collectionName = "pages"
-
-const wikiIdKey = "wikiId"
-const wikiRefKey = "ref"
-const versionKey = "version"
-const textKey = "text"
-const userIdKey = "userId"
-
-const mongoCallMsg = "Failed during MongoDB call"
+const storeCallMsg = "Failed during store call"
 
 var errInternal = errors.New("internal service error")
-
-var descVersion = bson.D{{Key: versionKey, Value: -1}}
-var contentFields = bson.D{
-	// exclude unused fields
-	{Key: wikiIdKey, Value: false}, {Key: wikiRefKey, Value: false}, {Key: userIdKey, Value: false},
-}
-var optsContentMaxVersion = options.FindOne().SetSort(descVersion).SetProjection(contentFields)
-var optsContentFields = options.FindOne().SetProjection(contentFields)
-var optsVersion = options.Find().SetProjection(
-	bson.D{{Key: versionKey, Value: true}, {Key: userIdKey, Value: true}},
-)
+var errNotFound = errors.New("not found")
 
 // server is used to implement puzzlewikiservice.WikiServer
 type server struct {
 	pb.UnimplementedWikiServer
-	clientOptions *options.ClientOptions
-	databaseName  string
-	logger        *otelzap.Logger
+	store  store.Store
+	logger *otelzap.Logger
 }
 
-func New(clientOptions *options.ClientOptions, databaseName string, logger *otelzap.Logger) pb.WikiServer {
-	return server{clientOptions: clientOptions, databaseName: databaseName, logger: logger}
+func New(store store.Store, logger *otelzap.Logger) pb.WikiServer {
+	return server{store: store, logger: logger}
 }
 
 func (s server) Load(ctx context.Context, request *pb.WikiRequest) (*pb.Content, error) {
-	logger := s.logger.Ctx(ctx)
-	client, err := mongo.Connect(ctx, s.clientOptions)
+	page, err := s.store.Load(ctx, request.WikiId, request.WikiRef, request.Version)
 	if err != nil {
-		logger.Error(mongoCallMsg, zap.Error(err))
+		s.logger.Ctx(ctx).Error(storeCallMsg, zap.Error(err))
 		return nil, errInternal
 	}
-	defer mongoclient.Disconnect(client, logger)
-
-	collection := client.Database(s.databaseName).Collection(collectionName)
-
-	filters := bson.D{
-		{Key: wikiIdKey, Value: request.WikiId}, {Key: wikiRefKey, Value: request.WikiRef},
+	if page == nil {
+		// an empty Content has Version 0, which is recognized by client
+		return &pb.Content{}, nil
 	}
+	return convertToContent(page), nil
+}
 
-	opts := optsContentMaxVersion
-	if version := request.Version; version != 0 {
-		filters = append(filters, bson.E{Key: versionKey, Value: version})
-		opts = optsContentFields
+func (s server) Store(ctx context.Context, request *pb.ContentRequest) (*pb.Response, error) {
+	page := store.Page{
+		WikiId: request.WikiId, WikiRef: request.WikiRef, Version: request.Last + 1,
+		UserId: request.UserId, Text: request.Text,
 	}
 
-	var result bson.M
-	err = collection.FindOne(ctx, filters, opts).Decode(&result)
-	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			// an empty Content has Version 0, which is recognized by client
-			return &pb.Content{}, nil
+	if err := s.store.Insert(ctx, page); err != nil {
+		if errors.Is(err, store.ErrDuplicateVersion) {
+			return &pb.Response{}, nil
 		}
 
-		logger.Error(mongoCallMsg, zap.Error(err))
+		s.logger.Ctx(ctx).Error(storeCallMsg, zap.Error(err))
 		return nil, errInternal
 	}
-	return convertToContent(result), nil
+	return &pb.Response{Success: true}, nil
 }
 
-func (s server) Store(ctx context.Context, request *pb.ContentRequest) (*pb.Response, error) {
-	logger := s.logger.Ctx(ctx)
-	client, err := mongo.Connect(ctx, s.clientOptions)
+func (s server) ListVersions(ctx context.Context, request *pb.VersionRequest) (*pb.Versions, error) {
+	versions, err := s.store.ListVersions(ctx, request.WikiId, request.WikiRef)
 	if err != nil {
-		logger.Error(mongoCallMsg, zap.Error(err))
+		s.logger.Ctx(ctx).Error(storeCallMsg, zap.Error(err))
 		return nil, errInternal
 	}
-	defer mongoclient.Disconnect(client, logger)
 
-	collection := client.Database(s.databaseName).Collection(collectionName)
-
-	// rely on the mongo server to ensure there will be no duplicate
-	newVersion := request.Last + 1
-	page := bson.M{
-		wikiIdKey: request.WikiId, wikiRefKey: request.WikiRef, versionKey: newVersion,
-		userIdKey: request.UserId, textKey: request.Text,
+	list := make([]*pb.Version, 0, len(versions))
+	for _, version := range versions {
+		list = append(list, convertToVersion(version))
 	}
+	return &pb.Versions{List: list}, nil
+}
 
-	_, err = collection.InsertOne(ctx, page)
-	if err != nil {
-		if mongo.IsDuplicateKeyError(err) {
-			return &pb.Response{}, nil
-		}
-
-		logger.Error(mongoCallMsg, zap.Error(err))
+func (s server) Delete(ctx context.Context, request *pb.WikiRequest) (*pb.Response, error) {
+	if err := s.store.DeleteVersion(ctx, request.WikiId, request.WikiRef, request.Version); err != nil {
+		s.logger.Ctx(ctx).Error(storeCallMsg, zap.Error(err))
 		return nil, errInternal
 	}
 	return &pb.Response{Success: true}, nil
 }
 
-func (s server) ListVersions(ctx context.Context, request *pb.VersionRequest) (*pb.Versions, error) {
+// StoreBatch inserts every entry as a single unit: on a backend that
+// supports it (see store.Store.InsertBatch) either all entries commit or
+// none do, which is useful for wiki imports and cross-page refactors.
+func (s server) StoreBatch(ctx context.Context, request *BatchContentRequest) (*BatchResponse, error) {
 	logger := s.logger.Ctx(ctx)
-	client, err := mongo.Connect(ctx, s.clientOptions)
+
+	pages := make([]store.Page, 0, len(request.Entries))
+	for _, entry := range request.Entries {
+		pages = append(pages, store.Page{
+			WikiId: entry.WikiId, WikiRef: entry.WikiRef, Version: entry.Last + 1,
+			UserId: entry.UserId, Text: entry.Text,
+		})
+	}
+
+	results, err := s.store.InsertBatch(ctx, pages)
 	if err != nil {
-		logger.Error(mongoCallMsg, zap.Error(err))
+		logger.Error(storeCallMsg, zap.Error(err))
 		return nil, errInternal
 	}
-	defer mongoclient.Disconnect(client, logger)
 
-	collection := client.Database(s.databaseName).Collection(collectionName)
+	responses := make([]*BatchResult, len(results))
+	for i, result := range results {
+		response := &BatchResult{Success: result.Success}
+		if result.Err != nil {
+			response.Reason = result.Err.Error()
+		}
+		responses[i] = response
+	}
+	return &BatchResponse{Results: responses}, nil
+}
 
-	cursor, err := collection.Find(ctx, bson.D{
-		{Key: wikiIdKey, Value: request.WikiId}, {Key: wikiRefKey, Value: request.WikiRef},
-	}, optsVersion)
+// Restore loads a past version of a page and inserts it again as the
+// newest version, so history is preserved rather than mutated in place.
+func (s server) Restore(ctx context.Context, request *RestoreRequest) (*pb.Response, error) {
+	logger := s.logger.Ctx(ctx)
+
+	source, err := s.store.Load(ctx, request.WikiId, request.WikiRef, request.Version)
 	if err != nil {
-		logger.Error(mongoCallMsg, zap.Error(err))
+		logger.Error(storeCallMsg, zap.Error(err))
 		return nil, errInternal
 	}
+	if source == nil {
+		return nil, errNotFound
+	}
 
-	var results []bson.M
-	if err = cursor.All(ctx, &results); err != nil {
-		logger.Error(mongoCallMsg, zap.Error(err))
-		return nil, errInternal
+	for {
+		last, err := s.store.Load(ctx, request.WikiId, request.WikiRef, 0)
+		if err != nil {
+			logger.Error(storeCallMsg, zap.Error(err))
+			return nil, errInternal
+		}
+
+		newVersion := uint64(1)
+		if last != nil {
+			newVersion = last.Version + 1
+		}
+
+		page := store.Page{
+			WikiId: request.WikiId, WikiRef: request.WikiRef, Version: newVersion,
+			UserId: request.UserId, Text: source.Text,
+		}
+
+		err = s.store.Insert(ctx, page)
+		if err == nil {
+			return &pb.Response{Success: true}, nil
+		}
+		if !errors.Is(err, store.ErrDuplicateVersion) {
+			logger.Error(storeCallMsg, zap.Error(err))
+			return nil, errInternal
+		}
+		// another writer took newVersion first, retry against the fresh Last
 	}
-	return &pb.Versions{List: mongoclient.ConvertSlice(results, convertToVersion)}, nil
 }
 
-func (s server) Delete(ctx context.Context, request *pb.WikiRequest) (*pb.Response, error) {
+// Diff computes a line-oriented unified diff between two versions of a
+// page, server-side, so clients do not need to fetch both texts.
+func (s server) Diff(ctx context.Context, request *DiffRequest) (*DiffResult, error) {
 	logger := s.logger.Ctx(ctx)
-	client, err := mongo.Connect(ctx, s.clientOptions)
+
+	from, err := s.store.Load(ctx, request.WikiId, request.WikiRef, request.FromVersion)
+	if err != nil {
+		logger.Error(storeCallMsg, zap.Error(err))
+		return nil, errInternal
+	}
+
+	to, err := s.store.Load(ctx, request.WikiId, request.WikiRef, request.ToVersion)
 	if err != nil {
-		logger.Error(mongoCallMsg, zap.Error(err))
+		logger.Error(storeCallMsg, zap.Error(err))
 		return nil, errInternal
 	}
-	defer mongoclient.Disconnect(client, logger)
 
-	collection := client.Database(s.databaseName).Collection(collectionName)
+	if from == nil || to == nil {
+		return nil, errNotFound
+	}
+
+	dmp := diffmatchpatch.New()
+	fromChars, toChars, lines := dmp.DiffLinesToChars(from.Text, to.Text)
+	diffs := dmp.DiffCharsToLines(dmp.DiffMain(fromChars, toChars, false), lines)
+	patches := dmp.PatchMake(from.Text, diffs)
+	return &DiffResult{Patch: dmp.PatchToText(patches)}, nil
+}
 
-	_, err = collection.DeleteMany(ctx, bson.D{
-		{Key: wikiIdKey, Value: request.WikiId}, {Key: wikiRefKey, Value: request.WikiRef},
-		{Key: versionKey, Value: request.Version},
-	})
+// Search finds the latest version of every page matching request.Query,
+// optionally scoped to a single wiki, paginated by request.Limit/Offset.
+func (s server) Search(ctx context.Context, request *SearchRequest) (*SearchResults, error) {
+	results, err := s.store.Search(ctx, request.WikiId, request.Query, request.Limit, request.Offset)
 	if err != nil {
-		logger.Error(mongoCallMsg, zap.Error(err))
+		s.logger.Ctx(ctx).Error(storeCallMsg, zap.Error(err))
 		return nil, errInternal
 	}
-	return &pb.Response{Success: true}, nil
+
+	list := make([]*SearchResult, 0, len(results))
+	for _, result := range results {
+		list = append(list, convertToSearchResult(result))
+	}
+	return &SearchResults{List: list}, nil
 }
 
-func convertToContent(page bson.M) *pb.Content {
-	text, _ := page[textKey].(string)
-	return &pb.Content{
-		Version: mongoclient.ExtractUint64(page[versionKey]),
-		Text:    text, CreatedAt: mongoclient.ExtractCreateDate(page).Unix(),
+// Ready reports whether the backing store is reachable, for wiring into a
+// readiness probe. Stores that do not support pinging are always ready.
+func (s server) Ready(ctx context.Context) error {
+	pinger, ok := s.store.(store.Pinger)
+	if !ok {
+		return nil
 	}
+	return pinger.Ping(ctx)
+}
+
+// Close releases any resources held by the backing store. It should be
+// called once on graceful shutdown.
+func (s server) Close(ctx context.Context) error {
+	closer, ok := s.store.(store.Closer)
+	if !ok {
+		return nil
+	}
+	return closer.Close(ctx)
+}
+
+func convertToContent(page *store.Page) *pb.Content {
+	return &pb.Content{Version: page.Version, Text: page.Text, CreatedAt: page.CreatedAt.Unix()}
+}
+
+func convertToVersion(version store.Version) *pb.Version {
+	return &pb.Version{Number: version.Number, UserId: version.UserId}
 }
 
-func convertToVersion(page bson.M) *pb.Version {
-	return &pb.Version{
-		Number: mongoclient.ExtractUint64(page[versionKey]),
-		UserId: mongoclient.ExtractUint64(page[userIdKey]),
+func convertToSearchResult(result store.SearchResult) *SearchResult {
+	return &SearchResult{
+		WikiRef: result.WikiRef, Version: result.Version,
+		Snippet: result.Snippet, CreatedAt: result.CreatedAt.Unix(),
 	}
 }
@@ -0,0 +1,169 @@
+/*
+ *
+ * Copyright 2023 puzzlewikiserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package wikiserver
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	pb "github.com/dvaumoron/puzzlewikiservice"
+	"github.com/dvaumoron/puzzlewikiserver/wikiserver/store"
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.uber.org/zap"
+)
+
+// fakeStore is a store.Store whose behavior is supplied per test via its
+// function fields, so each test only wires up the calls it cares about.
+type fakeStore struct {
+	loadFunc        func(ctx context.Context, wikiId uint64, wikiRef string, version uint64) (*store.Page, error)
+	insertFunc      func(ctx context.Context, page store.Page) error
+	insertBatchFunc func(ctx context.Context, pages []store.Page) ([]store.BatchResult, error)
+}
+
+func (f fakeStore) Load(ctx context.Context, wikiId uint64, wikiRef string, version uint64) (*store.Page, error) {
+	return f.loadFunc(ctx, wikiId, wikiRef, version)
+}
+
+func (f fakeStore) Insert(ctx context.Context, page store.Page) error {
+	return f.insertFunc(ctx, page)
+}
+
+func (f fakeStore) ListVersions(ctx context.Context, wikiId uint64, wikiRef string) ([]store.Version, error) {
+	return nil, nil
+}
+
+func (f fakeStore) DeleteVersion(ctx context.Context, wikiId uint64, wikiRef string, version uint64) error {
+	return nil
+}
+
+func (f fakeStore) InsertBatch(ctx context.Context, pages []store.Page) ([]store.BatchResult, error) {
+	return f.insertBatchFunc(ctx, pages)
+}
+
+func (f fakeStore) Search(ctx context.Context, wikiId uint64, query string, limit, offset int64) ([]store.SearchResult, error) {
+	return nil, nil
+}
+
+func newTestServer(s store.Store) server {
+	return server{store: s, logger: otelzap.New(zap.NewNop())}
+}
+
+func TestLoadReturnsEmptyContentWhenPageNotFound(t *testing.T) {
+	s := newTestServer(fakeStore{
+		loadFunc: func(ctx context.Context, wikiId uint64, wikiRef string, version uint64) (*store.Page, error) {
+			return nil, nil
+		},
+	})
+
+	content, err := s.Load(context.Background(), &pb.WikiRequest{WikiId: 1, WikiRef: "missing"})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if content.Version != 0 {
+		t.Fatalf("expected an empty Content (Version 0), got %+v", content)
+	}
+}
+
+func TestStoreReturnsEmptyResponseOnDuplicateVersion(t *testing.T) {
+	s := newTestServer(fakeStore{
+		insertFunc: func(ctx context.Context, page store.Page) error {
+			return store.ErrDuplicateVersion
+		},
+	})
+
+	response, err := s.Store(context.Background(), &pb.ContentRequest{WikiId: 1, WikiRef: "a", Last: 0})
+	if err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if response.Success {
+		t.Fatalf("expected Success false on a duplicate version, got %+v", response)
+	}
+}
+
+func TestRestoreRetriesPastAConcurrentDuplicateVersion(t *testing.T) {
+	source := &store.Page{WikiId: 1, WikiRef: "a", Version: 1, Text: "restored text"}
+	current := &store.Page{WikiId: 1, WikiRef: "a", Version: 3}
+
+	var insertAttempts int
+	s := newTestServer(fakeStore{
+		loadFunc: func(ctx context.Context, wikiId uint64, wikiRef string, version uint64) (*store.Page, error) {
+			if version != 0 {
+				return source, nil
+			}
+			return current, nil
+		},
+		insertFunc: func(ctx context.Context, page store.Page) error {
+			insertAttempts++
+			if insertAttempts == 1 {
+				// another writer raced us to version 4; Restore should retry
+				// against the fresh Last instead of surfacing this error.
+				return store.ErrDuplicateVersion
+			}
+			if page.Version != 4 {
+				t.Fatalf("expected the retry to target version 4, got %d", page.Version)
+			}
+			if page.Text != source.Text {
+				t.Fatalf("expected the retried insert to carry the restored text, got %q", page.Text)
+			}
+			return nil
+		},
+	})
+
+	response, err := s.Restore(context.Background(), &RestoreRequest{WikiId: 1, WikiRef: "a", Version: 1, UserId: 7})
+	if err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if !response.Success {
+		t.Fatalf("expected Success true after the retry succeeds, got %+v", response)
+	}
+	if insertAttempts != 2 {
+		t.Fatalf("expected exactly 2 insert attempts, got %d", insertAttempts)
+	}
+}
+
+func TestStoreBatchSurfacesPerEntryReason(t *testing.T) {
+	s := newTestServer(fakeStore{
+		insertBatchFunc: func(ctx context.Context, pages []store.Page) ([]store.BatchResult, error) {
+			return []store.BatchResult{
+				{Success: true},
+				{Success: false, Err: errors.New("entry 1: version already exists; transaction aborted")},
+			}, nil
+		},
+	})
+
+	response, err := s.StoreBatch(context.Background(), &BatchContentRequest{
+		Entries: []*pb.ContentRequest{
+			{WikiId: 1, WikiRef: "a"},
+			{WikiId: 1, WikiRef: "b"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("StoreBatch: %v", err)
+	}
+	if len(response.Results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(response.Results))
+	}
+	if !response.Results[0].Success || response.Results[0].Reason != "" {
+		t.Fatalf("expected the first entry to succeed with no reason, got %+v", response.Results[0])
+	}
+	if response.Results[1].Success || response.Results[1].Reason == "" {
+		t.Fatalf("expected the second entry's failure reason to be surfaced, got %+v", response.Results[1])
+	}
+}